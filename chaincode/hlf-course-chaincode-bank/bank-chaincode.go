@@ -1,56 +1,599 @@
+// Package main implements the bank chaincode. queryAccounts relies on Mango
+// selector queries, so the channel's peers must run CouchDB as their state
+// database; supporting indexes live under META-INF/statedb/couchdb/indexes.
 package main
 
 import (
 	"encoding/json"
 	"fmt"
 	"strconv"
+	"strings"
 
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/common/cauthdsl"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
 	"github.com/hyperledger/fabric/protos/peer"
 )
 
+// adminKey stores the identity that instantiated the chaincode; it always
+// passes requireRole checks, independent of any granted role.
+const adminKey = "chaincode~admin"
+
 type BankAccount struct {
-	PersonID      uint64  `json:person_id`
+	PersonID      uint64  `json:"person_id"`
+	AccountNumber string  `json:"account_number"`
+	Balance       float64 `json:"balance"`
+	OwnerMSP      string  `json:"owner_msp"`
+}
+
+// Token is an issuable currency. Only its Issuer may mint, burn or lock it.
+type Token struct {
+	Symbol      string  `json:"symbol"`
+	Name        string  `json:"name"`
+	Issuer      string  `json:"issuer"`
+	TotalSupply float64 `json:"total_supply"`
+	Locked      bool    `json:"locked"`
+}
+
+// Account is a (bank account, token) balance, keyed by a composite key so a
+// single bank account can hold several currencies.
+type Account struct {
 	AccountNumber string  `json:account_number`
+	Symbol        string  `json:"symbol"`
 	Balance       float64 `json:balance`
+	Frozen        bool    `json:"frozen"`
+}
+
+// TxRecord is one leg of a transfer, written once per participating account
+// under a "tx" composite key so getHistory can reconstruct the debit/credit
+// stream without replaying every historic state value.
+type TxRecord struct {
+	TxID      string               `json:"tx_id"`
+	From      string               `json:"from"`
+	To        string               `json:"to"`
+	Symbol    string               `json:"symbol"`
+	Amount    float64              `json:"amount"`
+	Timestamp *timestamp.Timestamp `json:"timestamp"`
+}
+
+// BalanceSnapshot is a single historic value of an account's state, as
+// reported by GetHistoryForKey.
+type BalanceSnapshot struct {
+	TxID      string               `json:"tx_id"`
+	Value     string               `json:"value"`
+	IsDelete  bool                 `json:"is_delete"`
+	Timestamp *timestamp.Timestamp `json:"timestamp"`
+}
+
+// SignedTx is a TxRecord resolved to the perspective of a single account:
+// Amount is negative for a debit and positive for a credit.
+type SignedTx struct {
+	TxID         string               `json:"tx_id"`
+	Counterparty string               `json:"counterparty"`
+	Amount       float64              `json:"amount"`
+	Timestamp    *timestamp.Timestamp `json:"timestamp"`
+}
+
+// TransferOp is one row of a transferBatch request.
+type TransferOp struct {
+	From   string  `json:"from"`
+	To     string  `json:"to"`
+	Symbol string  `json:"symbol"`
+	Amount float64 `json:"amount"`
+}
+
+// BatchFailure reports one failed row of a batch operation, following the
+// bill-chaincode {id, errInfo} convention.
+type BatchFailure struct {
+	Index   int    `json:"index"`
+	ID      string `json:"id"`
+	ErrInfo string `json:"err_info"`
+}
+
+// BatchResult is returned by addAccountsBatch/transferBatch: rows that
+// succeeded don't abort rows that failed.
+type BatchResult struct {
+	Successes []string       `json:"successes"`
+	Failures  []BatchFailure `json:"failures"`
+}
+
+// BatchSummary is emitted as the BatchProcessed event payload so downstream
+// consumers can correlate it with the batch's single transaction.
+type BatchSummary struct {
+	TxID      string `json:"tx_id"`
+	Operation string `json:"operation"`
+	Successes int    `json:"successes"`
+	Failures  int    `json:"failures"`
 }
 
 type bankManagement struct {
 }
 
+// callerIdentity returns a "mspid/commonName" string identifying the
+// transaction invoker, used to gate issuer-only token operations.
+func callerIdentity(stub shim.ChaincodeStubInterface) (string, error) {
+	mspID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return "", fmt.Errorf("failed to get invoker MSP ID, due to %s", err)
+	}
+
+	cert, err := cid.GetX509Certificate(stub)
+	if err != nil {
+		return "", fmt.Errorf("failed to get invoker certificate, due to %s", err)
+	}
+
+	return fmt.Sprintf("%s/%s", mspID, cert.Subject.CommonName), nil
+}
+
+func accountKey(stub shim.ChaincodeStubInterface, accountNumber, symbol string) (string, error) {
+	return stub.CreateCompositeKey("account", []string{accountNumber, symbol})
+}
+
+func getToken(stub shim.ChaincodeStubInterface, symbol string) (*Token, error) {
+	tokenState, err := stub.GetState(symbol)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get token %s, due to %s", symbol, err)
+	}
+	if tokenState == nil {
+		return nil, fmt.Errorf("token %s doesn't exist", symbol)
+	}
+
+	var token Token
+	if err := json.Unmarshal(tokenState, &token); err != nil {
+		return nil, fmt.Errorf("failed to deserialize token %s, due to %s", symbol, err)
+	}
+
+	return &token, nil
+}
+
+func putToken(stub shim.ChaincodeStubInterface, token *Token) error {
+	bytes, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("failed to serialize token %s, due to %s", token.Symbol, err)
+	}
+
+	return stub.PutState(token.Symbol, bytes)
+}
+
+// requireIssuer fails unless the caller is the identity that created symbol.
+func requireIssuer(stub shim.ChaincodeStubInterface, token *Token) error {
+	caller, err := callerIdentity(stub)
+	if err != nil {
+		return err
+	}
+
+	if caller != token.Issuer {
+		return fmt.Errorf("only the issuer of %s may perform this operation", token.Symbol)
+	}
+
+	return nil
+}
+
+// splitIdentity parses the "mspid/commonName" format produced by
+// callerIdentity back into its two parts.
+func splitIdentity(identity string) (mspID string, commonName string, err error) {
+	parts := strings.SplitN(identity, "/", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("malformed identity %s, expected mspid/commonName", identity)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+func roleKey(stub shim.ChaincodeStubInterface, mspID, commonName string) (string, error) {
+	return stub.CreateCompositeKey("role", []string{mspID, commonName})
+}
+
+func getRoles(stub shim.ChaincodeStubInterface, key string) ([]string, error) {
+	rolesState, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get roles, due to %s", err)
+	}
+	if rolesState == nil {
+		return nil, nil
+	}
+
+	var roles []string
+	if err := json.Unmarshal(rolesState, &roles); err != nil {
+		return nil, fmt.Errorf("failed to deserialize roles, due to %s", err)
+	}
+
+	return roles, nil
+}
+
+// requireRole fails unless the caller is the chaincode admin recorded on
+// Init or has been granted role via grantRole.
+func requireRole(stub shim.ChaincodeStubInterface, role string) error {
+	caller, err := callerIdentity(stub)
+	if err != nil {
+		return err
+	}
+
+	adminState, err := stub.GetState(adminKey)
+	if err != nil {
+		return fmt.Errorf("failed to check chaincode admin, due to %s", err)
+	}
+	if adminState != nil && string(adminState) == caller {
+		return nil
+	}
+
+	mspID, commonName, err := splitIdentity(caller)
+	if err != nil {
+		return err
+	}
+
+	key, err := roleKey(stub, mspID, commonName)
+	if err != nil {
+		return err
+	}
+
+	roles, err := getRoles(stub, key)
+	if err != nil {
+		return err
+	}
+
+	for _, granted := range roles {
+		if granted == role {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("caller %s doesn't have role %s", caller, role)
+}
+
+// setAccountEndorsementPolicy requires the account owner's org to endorse
+// any future write to that account's key, so a single malicious peer can't
+// forge a balance update. mspID must be the org that registered the bank
+// account (BankAccount.OwnerMSP), not whichever org happens to trigger the
+// key's first write, or any org could claim endorsement rights over a
+// victim's balance by racing to touch it first.
+func setAccountEndorsementPolicy(stub shim.ChaincodeStubInterface, key, mspID string) error {
+	policy, err := cauthdsl.SignedByAnyMember([]string{mspID})
+	if err != nil {
+		return fmt.Errorf("failed to build endorsement policy, due to %s", err)
+	}
+
+	return stub.SetStateValidationParameter(key, policy)
+}
+
+// addAccountInternal creates a single bank account and is shared by the
+// addAccount and addAccountsBatch actions. It always returns the account
+// number it parsed out of accountJSON, even on failure, so batch callers can
+// report which row an error belongs to.
+func addAccountInternal(stub shim.ChaincodeStubInterface, accountJSON string) (string, error) {
+	var account BankAccount
+	if err := json.Unmarshal([]byte(accountJSON), &account); err != nil {
+		return "", fmt.Errorf("failed to desirialize bank account information error %s", err)
+	}
+
+	// Need to check whenever account.PersonID is exists
+	personID := fmt.Sprintf("%d", account.PersonID)
+	response := stub.InvokeChaincode("personCC", [][]byte{[]byte("getPerson"), []byte(personID)}, "mychannel")
+	if response.Status == shim.ERROR {
+		return account.AccountNumber, fmt.Errorf("failed to create bank account for person with id %s, due to %s", personID, response.Message)
+	}
+
+	accountState, err := stub.GetState(account.AccountNumber)
+	if err != nil {
+		return account.AccountNumber, fmt.Errorf("failed to create bank account due to %s", err)
+	}
+	if accountState != nil {
+		return account.AccountNumber, fmt.Errorf("bank account with number %s already exists", account.AccountNumber)
+	}
+
+	// OwnerMSP is recorded from the registering org, not taken from
+	// accountJSON, so a caller can't claim ownership of someone else's
+	// account by setting the field in the request.
+	ownerMSP, err := cid.GetMSPID(stub)
+	if err != nil {
+		return account.AccountNumber, fmt.Errorf("failed to create bank account due to %s", err)
+	}
+	account.OwnerMSP = ownerMSP
+
+	accountBytes, err := json.Marshal(account)
+	if err != nil {
+		return account.AccountNumber, fmt.Errorf("failed to serialize bank account with number %s, due to %s", account.AccountNumber, err)
+	}
+	if err := stub.PutState(account.AccountNumber, accountBytes); err != nil {
+		return account.AccountNumber, fmt.Errorf("failed to save bank account with number %s, due to %s", account.AccountNumber, err)
+	}
+
+	indexKey, err := personAccountKey(stub, personID, account.AccountNumber)
+	if err != nil {
+		return account.AccountNumber, fmt.Errorf("failed to index bank account with number %s, due to %s", account.AccountNumber, err)
+	}
+	if err := stub.PutState(indexKey, []byte{0x00}); err != nil {
+		return account.AccountNumber, fmt.Errorf("failed to index bank account with number %s, due to %s", account.AccountNumber, err)
+	}
+
+	return account.AccountNumber, nil
+}
+
+// getAccount loads the balance record for (accountNumber, symbol), returning
+// a zero-balance Account and its storage key if none exists yet. accountNumber
+// must already be a registered BankAccount (added via addAccount) — this is
+// the only place that guard is enforced, so every caller that resolves a
+// balance by accountNumber must go through here rather than building the
+// composite key itself.
+func getAccount(stub shim.ChaincodeStubInterface, accountNumber, symbol string) (*Account, string, error) {
+	bankAccountState, err := stub.GetState(accountNumber)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get account %s, due to %s", accountNumber, err)
+	}
+	if bankAccountState == nil {
+		return nil, "", fmt.Errorf("bank account with number %s doesn't exists", accountNumber)
+	}
+
+	key, err := accountKey(stub, accountNumber, symbol)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to build account key for %s/%s, due to %s", accountNumber, symbol, err)
+	}
+
+	accountState, err := stub.GetState(key)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get account %s/%s, due to %s", accountNumber, symbol, err)
+	}
+
+	account := Account{AccountNumber: accountNumber, Symbol: symbol}
+	if accountState != nil {
+		if err := json.Unmarshal(accountState, &account); err != nil {
+			return nil, "", fmt.Errorf("failed to deserialize account %s/%s, due to %s", accountNumber, symbol, err)
+		}
+	}
+
+	return &account, key, nil
+}
+
+func putAccount(stub shim.ChaincodeStubInterface, key string, account *Account) error {
+	existingState, err := stub.GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to check existing account %s/%s, due to %s", account.AccountNumber, account.Symbol, err)
+	}
+
+	bytes, err := json.Marshal(account)
+	if err != nil {
+		return fmt.Errorf("failed to serialize account %s/%s, due to %s", account.AccountNumber, account.Symbol, err)
+	}
+
+	if err := stub.PutState(key, bytes); err != nil {
+		return err
+	}
+
+	if existingState == nil {
+		bankAccountState, err := stub.GetState(account.AccountNumber)
+		if err != nil {
+			return fmt.Errorf("failed to look up owning org of %s, due to %s", account.AccountNumber, err)
+		}
+
+		var bankAccount BankAccount
+		if err := json.Unmarshal(bankAccountState, &bankAccount); err != nil {
+			return fmt.Errorf("failed to look up owning org of %s, due to %s", account.AccountNumber, err)
+		}
+
+		if err := setAccountEndorsementPolicy(stub, key, bankAccount.OwnerMSP); err != nil {
+			return fmt.Errorf("failed to set endorsement policy for %s/%s, due to %s", account.AccountNumber, account.Symbol, err)
+		}
+	}
+
+	return nil
+}
+
+func txKey(stub shim.ChaincodeStubInterface, accountNumber, symbol, txID string) (string, error) {
+	return stub.CreateCompositeKey("tx", []string{accountNumber, symbol, txID})
+}
+
+// recordTransfer logs a completed transfer under both participants' tx keys.
+// A peer only keeps the last SetEvent call of a transaction, so emitEvent
+// must be false for legs of a transferBatch, which emits one BatchProcessed
+// event for the whole transaction instead.
+func recordTransfer(stub shim.ChaincodeStubInterface, from, to, symbol string, amount float64, emitEvent bool) error {
+	timestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return fmt.Errorf("failed to get transaction timestamp, due to %s", err)
+	}
+
+	record := TxRecord{
+		TxID:      stub.GetTxID(),
+		From:      from,
+		To:        to,
+		Symbol:    symbol,
+		Amount:    amount,
+		Timestamp: timestamp,
+	}
+
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to serialize transfer record, due to %s", err)
+	}
+
+	fromKey, err := txKey(stub, from, symbol, record.TxID)
+	if err != nil {
+		return fmt.Errorf("failed to build transfer log key for %s, due to %s", from, err)
+	}
+	if err := stub.PutState(fromKey, recordBytes); err != nil {
+		return fmt.Errorf("failed to log transfer for %s, due to %s", from, err)
+	}
+
+	toKey, err := txKey(stub, to, symbol, record.TxID)
+	if err != nil {
+		return fmt.Errorf("failed to build transfer log key for %s, due to %s", to, err)
+	}
+	if err := stub.PutState(toKey, recordBytes); err != nil {
+		return fmt.Errorf("failed to log transfer for %s, due to %s", to, err)
+	}
+
+	if !emitEvent {
+		return nil
+	}
+
+	return stub.SetEvent("Transfer", recordBytes)
+}
+
+// emitBatchProcessed summarizes a batch action as a single chaincode event.
+func emitBatchProcessed(stub shim.ChaincodeStubInterface, operation string, successes, failures int) error {
+	summary := BatchSummary{
+		TxID:      stub.GetTxID(),
+		Operation: operation,
+		Successes: successes,
+		Failures:  failures,
+	}
+
+	summaryBytes, err := json.Marshal(summary)
+	if err != nil {
+		return fmt.Errorf("failed to serialize batch summary, due to %s", err)
+	}
+
+	return stub.SetEvent("BatchProcessed", summaryBytes)
+}
+
+// transferInternal moves amount of symbol from one account to another and is
+// shared by the transfer and transferBatch actions.
+func transferInternal(stub shim.ChaincodeStubInterface, from, to, symbol string, amount float64, emitEvent bool) error {
+	if amount <= 0 {
+		return fmt.Errorf("amount must be positive")
+	}
+
+	token, err := getToken(stub, symbol)
+	if err != nil {
+		return fmt.Errorf("failed to transfer %s, due to %s", symbol, err)
+	}
+	if token.Locked {
+		return fmt.Errorf("token %s is locked", symbol)
+	}
+
+	senderAccount, senderKey, err := getAccount(stub, from, symbol)
+	if err != nil {
+		return fmt.Errorf("failed to get sender account information due to %s", err)
+	}
+	if senderAccount.Frozen {
+		return fmt.Errorf("account %s is frozen for %s", from, symbol)
+	}
+	if senderAccount.Balance-amount < 0 {
+		return fmt.Errorf("sender doesn't have enough money")
+	}
+
+	receiverAccount, receiverKey, err := getAccount(stub, to, symbol)
+	if err != nil {
+		return fmt.Errorf("failed to get receiver account information due to %s", err)
+	}
+	if receiverAccount.Frozen {
+		return fmt.Errorf("account %s is frozen for %s", to, symbol)
+	}
+
+	senderAccount.Balance -= amount
+	receiverAccount.Balance += amount
+
+	if err := putAccount(stub, senderKey, senderAccount); err != nil {
+		return fmt.Errorf("failed to update balance of %s, due to %s", from, err)
+	}
+	if err := putAccount(stub, receiverKey, receiverAccount); err != nil {
+		return fmt.Errorf("failed to update balance of %s, due to %s", to, err)
+	}
+
+	if err := recordTransfer(stub, from, to, symbol, amount, emitEvent); err != nil {
+		return fmt.Errorf("failed to record transfer from %s to %s, due to %s", from, to, err)
+	}
+
+	return nil
+}
+
+// drainAccounts reads every remaining record off a state query iterator and
+// deserializes it as a BankAccount, for use with queryAccounts.
+func drainAccounts(iterator shim.StateQueryIteratorInterface) ([]BankAccount, error) {
+	var accounts []BankAccount
+
+	for iterator.HasNext() {
+		entry, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var account BankAccount
+		if err := json.Unmarshal(entry.Value, &account); err != nil {
+			return nil, fmt.Errorf("failed to deserialize account %s, due to %s", entry.Key, err)
+		}
+
+		accounts = append(accounts, account)
+	}
+
+	return accounts, nil
+}
+
+// personAccountKey builds the "person~account" composite key used to look up
+// every bank account owned by a given person without scanning the ledger.
+func personAccountKey(stub shim.ChaincodeStubInterface, personID, accountNumber string) (string, error) {
+	return stub.CreateCompositeKey("person~account", []string{personID, accountNumber})
+}
+
+// setAccountFreeze is shared by the freezeAccount/unfreezeAccount actions;
+// only the issuer of symbol may freeze or unfreeze transfers against it.
+func setAccountFreeze(stub shim.ChaincodeStubInterface, accountNumber, symbol string, frozen bool) peer.Response {
+	token, err := getToken(stub, symbol)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to update freeze state of %s/%s, due to %s", accountNumber, symbol, err))
+	}
+	if err := requireIssuer(stub, token); err != nil {
+		return shim.Error(fmt.Sprintf("failed to update freeze state of %s/%s, due to %s", accountNumber, symbol, err))
+	}
+
+	account, key, err := getAccount(stub, accountNumber, symbol)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to update freeze state of %s/%s, due to %s", accountNumber, symbol, err))
+	}
+
+	account.Frozen = frozen
+
+	if err := putAccount(stub, key, account); err != nil {
+		return shim.Error(fmt.Sprintf("failed to update freeze state of %s/%s, due to %s", accountNumber, symbol, err))
+	}
+
+	return shim.Success(nil)
+}
+
 var actions = map[string]func(stub shim.ChaincodeStubInterface, params []string) peer.Response{
 	"addAccount": func(stub shim.ChaincodeStubInterface, params []string) peer.Response {
 		if len(params) != 1 {
 			return shim.Error(fmt.Sprintf("wrong number of arguments"))
 		}
 
-		var account BankAccount
-		err := json.Unmarshal([]byte(params[0]), &account)
-		if err != nil {
-			return shim.Error(fmt.Sprintf("failed to desirialize bank account information error %s", err))
+		if _, err := addAccountInternal(stub, params[0]); err != nil {
+			return shim.Error(err.Error())
 		}
 
-		// Need to check whenever account.PersonID is exists
-		personID := fmt.Sprintf("%d", account.PersonID)
-		response := stub.InvokeChaincode("personCC", [][]byte{[]byte("getPerson"), []byte(personID)}, "mychannel")
-		if response.Status == shim.ERROR {
-			return shim.Error(fmt.Sprintf("failed to create bank account for person with id %s, due to %s", personID, err))
+		return shim.Success(nil)
+	},
+	"addAccountsBatch": func(stub shim.ChaincodeStubInterface, params []string) peer.Response {
+		if len(params) != 1 {
+			return shim.Error(fmt.Sprintf("wrong number of parameters(use: accounts)"))
 		}
 
-		accountState, err := stub.GetState(account.AccountNumber)
-		if err != nil {
-			return shim.Error(fmt.Sprintf("failed to create bank account due to %s", err))
+		var rawAccounts []json.RawMessage
+		if err := json.Unmarshal([]byte(params[0]), &rawAccounts); err != nil {
+			return shim.Error(fmt.Sprintf("failed to deserialize accounts batch, due to %s", err))
 		}
 
-		if accountState != nil {
-			return shim.Error(fmt.Sprintf("bank account with number %s already exists", account.AccountNumber))
+		var result BatchResult
+		for i, raw := range rawAccounts {
+			id, err := addAccountInternal(stub, string(raw))
+			if err != nil {
+				result.Failures = append(result.Failures, BatchFailure{Index: i, ID: id, ErrInfo: err.Error()})
+				continue
+			}
+
+			result.Successes = append(result.Successes, id)
 		}
 
-		if err := stub.PutState(account.AccountNumber, []byte(params[0])); err != nil {
-			shim.Error(fmt.Sprintf("failed to save bank account with number %s, due to %s", account.AccountNumber, err))
+		if err := emitBatchProcessed(stub, "addAccountsBatch", len(result.Successes), len(result.Failures)); err != nil {
+			return shim.Error(fmt.Sprintf("failed to emit batch event, due to %s", err))
 		}
 
-		return shim.Success(nil)
+		resultBytes, err := json.Marshal(result)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to serialize batch result, due to %s", err))
+		}
+
+		return shim.Success(resultBytes)
 	},
 	"delAccount": func(stub shim.ChaincodeStubInterface, params []string) peer.Response {
 		if len(params) != 1 {
@@ -67,111 +610,517 @@ var actions = map[string]func(stub shim.ChaincodeStubInterface, params []string)
 			return shim.Error(fmt.Sprintf("bank account with number %s doesn't exists", accountId))
 		}
 
+		var account BankAccount
+		if err := json.Unmarshal(accountState, &account); err != nil {
+			return shim.Error(fmt.Sprintf("failed to read account %s, due to %s", accountId, err))
+		}
+
 		if err := stub.DelState(accountId); err != nil {
 			return shim.Error(fmt.Sprintf("failed to delete account id %s, due to %s", params[0], err))
 		}
 
+		indexKey, err := personAccountKey(stub, fmt.Sprintf("%d", account.PersonID), accountId)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to unindex account id %s, due to %s", accountId, err))
+		}
+		if err := stub.DelState(indexKey); err != nil {
+			return shim.Error(fmt.Sprintf("failed to unindex account id %s, due to %s", accountId, err))
+		}
+
 		return shim.Success(nil)
 	},
 	"getBalance": func(stub shim.ChaincodeStubInterface, params []string) peer.Response {
-		if len(params) != 1 {
-			return shim.Error(fmt.Sprintf("wrong number of parameters"))
+		if len(params) != 2 {
+			return shim.Error(fmt.Sprintf("wrong number of parameters(use: accountNumber, symbol)"))
 		}
 
-		accountId := params[0]
-		accountState, err := stub.GetState(accountId)
+		account, _, err := getAccount(stub, params[0], params[1])
 		if err != nil {
-			return shim.Error(fmt.Sprintf("failed to get account information due to %s", err))
+			return shim.Error(fmt.Sprintf("failed to get balance of %s/%s, due to %s", params[0], params[1], err))
 		}
-		if accountState == nil {
-			return shim.Error(fmt.Sprintf("bank account with number %s doesn't exists", accountId))
+
+		balanceBytes, err := json.Marshal(account)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to serialize balance of %s/%s, due to %s", params[0], params[1], err))
 		}
 
-		return shim.Success(accountState.Balance)
+		return shim.Success(balanceBytes)
 	},
 	"transfer": func(stub shim.ChaincodeStubInterface, params []string) peer.Response {
-        if len(params) != 3 {
-            return shim.Error(fmt.Sprintf("wrong number of parameters(use: from, to, amount)"))
-        }
-
-		var senderAccount BankAccount
-		var receiverAccount BankAccount
-        from := params[0]
-        to := params[1]
-        amount, err := strconv.ParseFloat(params[2], 64)
-        if err != nil {
+		if len(params) != 4 {
+			return shim.Error(fmt.Sprintf("wrong number of parameters(use: from, to, symbol, amount)"))
+		}
+
+		amount, err := strconv.ParseFloat(params[3], 64)
+		if err != nil {
 			return shim.Error(fmt.Sprintf("failed to convert amount string to number"))
 		}
 
-        senderState, err := stub.GetState(from)
-        if err != nil {
-            return shim.Error(fmt.Sprintf("failed to get sender account information due to %s", err))
-        }
-        if senderState == nil {
-            return shim.Error(fmt.Sprintf("sender bank account with number %s doesn't exists", from))
-        }
-		if err := json.Unmarshal([]byte(senderState), &senderAccount); err != nil {
-			return shim.Error(fmt.Sprintf("failed to read senderState %s, due to %s", senderState, err))
+		if err := transferInternal(stub, params[0], params[1], params[2], amount, true); err != nil {
+			return shim.Error(err.Error())
 		}
-        if senderAccount.Balance - amount < 0 {
-			return shim.Error(fmt.Sprintf("sender doesn't have enough money"))
+
+		return shim.Success(nil)
+	},
+	"transferBatch": func(stub shim.ChaincodeStubInterface, params []string) peer.Response {
+		if len(params) != 1 {
+			return shim.Error(fmt.Sprintf("wrong number of parameters(use: transfers)"))
+		}
+
+		var ops []TransferOp
+		if err := json.Unmarshal([]byte(params[0]), &ops); err != nil {
+			return shim.Error(fmt.Sprintf("failed to deserialize transfers batch, due to %s", err))
+		}
+
+		var result BatchResult
+		for i, op := range ops {
+			id := fmt.Sprintf("%s->%s/%s", op.From, op.To, op.Symbol)
+			if err := transferInternal(stub, op.From, op.To, op.Symbol, op.Amount, false); err != nil {
+				result.Failures = append(result.Failures, BatchFailure{Index: i, ID: id, ErrInfo: err.Error()})
+				continue
+			}
+
+			result.Successes = append(result.Successes, id)
 		}
 
-		receiverState, err := stub.GetState(to)
+		if err := emitBatchProcessed(stub, "transferBatch", len(result.Successes), len(result.Failures)); err != nil {
+			return shim.Error(fmt.Sprintf("failed to emit batch event, due to %s", err))
+		}
+
+		resultBytes, err := json.Marshal(result)
 		if err != nil {
-			return shim.Error(fmt.Sprintf("failed to get receiver account information due to %s", err))
+			return shim.Error(fmt.Sprintf("failed to serialize batch result, due to %s", err))
 		}
-		if receiverState == nil {
-			return shim.Error(fmt.Sprintf("receiver bank account with number %s doesn't exists", to))
+
+		return shim.Success(resultBytes)
+	},
+	"createToken": func(stub shim.ChaincodeStubInterface, params []string) peer.Response {
+		if len(params) != 1 {
+			return shim.Error(fmt.Sprintf("wrong number of parameters(use: token)"))
 		}
-		if err := json.Unmarshal([]byte(receiverState), &receiverAccount); err != nil {
-			return shim.Error(fmt.Sprintf("failed to read senderState %s, due to %s", senderState, err))
+
+		var token Token
+		if err := json.Unmarshal([]byte(params[0]), &token); err != nil {
+			return shim.Error(fmt.Sprintf("failed to deserialize token information, due to %s", err))
 		}
 
-		senderAccount.Balance -= amount
-		receiverAccount.Balance += amount
+		tokenState, err := stub.GetState(token.Symbol)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to create token %s, due to %s", token.Symbol, err))
+		}
+		if tokenState != nil {
+			return shim.Error(fmt.Sprintf("token %s already exists", token.Symbol))
+		}
 
-		if err := stub.PutState(from, json.Marshal(senderAccount)); err != nil {
-			shim.Error(fmt.Sprintf("failed to update balance of %s, due to %s", from, err))
+		issuer, err := callerIdentity(stub)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to create token %s, due to %s", token.Symbol, err))
 		}
-		if err := stub.PutState(to, json.Marshal(receiverAccount)); err != nil {
-			shim.Error(fmt.Sprintf("failed to update balance of %s, due to %s", to, err))
+
+		token.Issuer = issuer
+		token.TotalSupply = 0
+		token.Locked = false
+
+		if err := putToken(stub, &token); err != nil {
+			return shim.Error(fmt.Sprintf("failed to save token %s, due to %s", token.Symbol, err))
 		}
 
 		return shim.Success(nil)
 	},
-	"getHistory": func(stub shim.ChaincodeStubInterface, params []string) peer.Response {
+	"mintToken": func(stub shim.ChaincodeStubInterface, params []string) peer.Response {
+		if len(params) != 3 {
+			return shim.Error(fmt.Sprintf("wrong number of parameters(use: symbol, accountNumber, amount)"))
+		}
+
+		symbol := params[0]
+		accountNumber := params[1]
+		amount, err := strconv.ParseFloat(params[2], 64)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to convert amount string to number"))
+		}
+		if amount <= 0 {
+			return shim.Error(fmt.Sprintf("amount must be positive"))
+		}
+
+		token, err := getToken(stub, symbol)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to mint %s, due to %s", symbol, err))
+		}
+		if err := requireIssuer(stub, token); err != nil {
+			return shim.Error(fmt.Sprintf("failed to mint %s, due to %s", symbol, err))
+		}
+
+		account, key, err := getAccount(stub, accountNumber, symbol)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to mint %s, due to %s", symbol, err))
+		}
+
+		token.TotalSupply += amount
+		account.Balance += amount
+
+		if err := putToken(stub, token); err != nil {
+			return shim.Error(fmt.Sprintf("failed to update total supply of %s, due to %s", symbol, err))
+		}
+		if err := putAccount(stub, key, account); err != nil {
+			return shim.Error(fmt.Sprintf("failed to credit %s with minted %s, due to %s", accountNumber, symbol, err))
+		}
+
+		return shim.Success(nil)
+	},
+	"burnToken": func(stub shim.ChaincodeStubInterface, params []string) peer.Response {
+		if len(params) != 3 {
+			return shim.Error(fmt.Sprintf("wrong number of parameters(use: symbol, accountNumber, amount)"))
+		}
+
+		symbol := params[0]
+		accountNumber := params[1]
+		amount, err := strconv.ParseFloat(params[2], 64)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to convert amount string to number"))
+		}
+		if amount <= 0 {
+			return shim.Error(fmt.Sprintf("amount must be positive"))
+		}
+
+		token, err := getToken(stub, symbol)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to burn %s, due to %s", symbol, err))
+		}
+		if err := requireIssuer(stub, token); err != nil {
+			return shim.Error(fmt.Sprintf("failed to burn %s, due to %s", symbol, err))
+		}
+
+		account, key, err := getAccount(stub, accountNumber, symbol)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to burn %s, due to %s", symbol, err))
+		}
+		if account.Balance-amount < 0 {
+			return shim.Error(fmt.Sprintf("account %s doesn't have enough %s to burn", accountNumber, symbol))
+		}
+
+		token.TotalSupply -= amount
+		account.Balance -= amount
+
+		if err := putToken(stub, token); err != nil {
+			return shim.Error(fmt.Sprintf("failed to update total supply of %s, due to %s", symbol, err))
+		}
+		if err := putAccount(stub, key, account); err != nil {
+			return shim.Error(fmt.Sprintf("failed to debit %s of burned %s, due to %s", accountNumber, symbol, err))
+		}
+
+		return shim.Success(nil)
+	},
+	"setTokenLock": func(stub shim.ChaincodeStubInterface, params []string) peer.Response {
+		if len(params) != 2 {
+			return shim.Error(fmt.Sprintf("wrong number of parameters(use: symbol, locked)"))
+		}
+
+		symbol := params[0]
+		locked, err := strconv.ParseBool(params[1])
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to convert locked string to bool"))
+		}
+
+		token, err := getToken(stub, symbol)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to lock %s, due to %s", symbol, err))
+		}
+		if err := requireIssuer(stub, token); err != nil {
+			return shim.Error(fmt.Sprintf("failed to lock %s, due to %s", symbol, err))
+		}
+
+		token.Locked = locked
+
+		if err := putToken(stub, token); err != nil {
+			return shim.Error(fmt.Sprintf("failed to update lock state of %s, due to %s", symbol, err))
+		}
+
+		return shim.Success(nil)
+	},
+	"freezeAccount": func(stub shim.ChaincodeStubInterface, params []string) peer.Response {
+		if len(params) != 2 {
+			return shim.Error(fmt.Sprintf("wrong number of parameters(use: accountNumber, symbol)"))
+		}
+
+		return setAccountFreeze(stub, params[0], params[1], true)
+	},
+	"unfreezeAccount": func(stub shim.ChaincodeStubInterface, params []string) peer.Response {
+		if len(params) != 2 {
+			return shim.Error(fmt.Sprintf("wrong number of parameters(use: accountNumber, symbol)"))
+		}
+
+		return setAccountFreeze(stub, params[0], params[1], false)
+	},
+	"queryAccounts": func(stub shim.ChaincodeStubInterface, params []string) peer.Response {
+		if len(params) != 1 && len(params) != 3 {
+			return shim.Error(fmt.Sprintf("wrong number of parameters(use: selector [, pageSize, bookmark])"))
+		}
+
+		selector := params[0]
+		var iterator shim.StateQueryIteratorInterface
+		var metadata *peer.QueryResponseMetadata
+		var err error
+
+		if len(params) == 3 {
+			pageSize, err := strconv.ParseInt(params[1], 10, 32)
+			if err != nil {
+				return shim.Error(fmt.Sprintf("failed to convert page size string to number"))
+			}
+
+			iterator, metadata, err = stub.GetQueryResultWithPagination(selector, int32(pageSize), params[2])
+			if err != nil {
+				return shim.Error(fmt.Sprintf("failed to run query %s, due to %s", selector, err))
+			}
+		} else {
+			iterator, err = stub.GetQueryResult(selector)
+			if err != nil {
+				return shim.Error(fmt.Sprintf("failed to run query %s, due to %s", selector, err))
+			}
+		}
+		defer iterator.Close()
+
+		accounts, err := drainAccounts(iterator)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to run query %s, due to %s", selector, err))
+		}
+
+		bookmark := ""
+		if metadata != nil {
+			bookmark = metadata.Bookmark
+		}
+
+		resultBytes, err := json.Marshal(struct {
+			Records  []BankAccount `json:"records"`
+			Bookmark string        `json:"bookmark"`
+		}{accounts, bookmark})
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to serialize query result, due to %s", err))
+		}
+
+		return shim.Success(resultBytes)
+	},
+	"getAccountsByPersonID": func(stub shim.ChaincodeStubInterface, params []string) peer.Response {
 		if len(params) != 1 {
-			return shim.Error(fmt.Sprintf("wrong number of parameters"))
+			return shim.Error(fmt.Sprintf("wrong number of parameters(use: personID)"))
 		}
 
-		var history []string
-		accountId := params[0]
+		personID := params[0]
 
-		historyIterator, err := stub.GetHistoryForKey(accountId)
+		iterator, err := stub.GetStateByPartialCompositeKey("person~account", []string{personID})
 		if err != nil {
-			shim.Error(fmt.Sprintf("failed to read history of %s, due to %s", accountId, err))
+			return shim.Error(fmt.Sprintf("failed to get accounts of person %s, due to %s", personID, err))
 		}
+		defer iterator.Close()
+
+		var accounts []BankAccount
+		for iterator.HasNext() {
+			indexEntry, err := iterator.Next()
+			if err != nil {
+				return shim.Error(fmt.Sprintf("failed to get accounts of person %s, due to %s", personID, err))
+			}
+
+			_, keyParts, err := stub.SplitCompositeKey(indexEntry.Key)
+			if err != nil {
+				return shim.Error(fmt.Sprintf("failed to get accounts of person %s, due to %s", personID, err))
+			}
+			accountNumber := keyParts[1]
 
+			accountState, err := stub.GetState(accountNumber)
+			if err != nil {
+				return shim.Error(fmt.Sprintf("failed to get account %s, due to %s", accountNumber, err))
+			}
+			if accountState == nil {
+				continue
+			}
+
+			var account BankAccount
+			if err := json.Unmarshal(accountState, &account); err != nil {
+				return shim.Error(fmt.Sprintf("failed to deserialize account %s, due to %s", accountNumber, err))
+			}
+
+			accounts = append(accounts, account)
+		}
+
+		resultBytes, err := json.Marshal(accounts)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to serialize accounts of person %s, due to %s", personID, err))
+		}
+
+		return shim.Success(resultBytes)
+	},
+	"grantRole": func(stub shim.ChaincodeStubInterface, params []string) peer.Response {
+		if len(params) != 2 {
+			return shim.Error(fmt.Sprintf("wrong number of parameters(use: identity, role)"))
+		}
+
+		mspID, commonName, err := splitIdentity(params[0])
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to grant role, due to %s", err))
+		}
+
+		key, err := roleKey(stub, mspID, commonName)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to grant role, due to %s", err))
+		}
+
+		roles, err := getRoles(stub, key)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to grant role, due to %s", err))
+		}
+
+		role := params[1]
+		for _, granted := range roles {
+			if granted == role {
+				return shim.Success(nil)
+			}
+		}
+		roles = append(roles, role)
+
+		rolesBytes, err := json.Marshal(roles)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to grant role, due to %s", err))
+		}
+		if err := stub.PutState(key, rolesBytes); err != nil {
+			return shim.Error(fmt.Sprintf("failed to grant role, due to %s", err))
+		}
+
+		return shim.Success(nil)
+	},
+	"revokeRole": func(stub shim.ChaincodeStubInterface, params []string) peer.Response {
+		if len(params) != 2 {
+			return shim.Error(fmt.Sprintf("wrong number of parameters(use: identity, role)"))
+		}
+
+		mspID, commonName, err := splitIdentity(params[0])
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to revoke role, due to %s", err))
+		}
+
+		key, err := roleKey(stub, mspID, commonName)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to revoke role, due to %s", err))
+		}
+
+		roles, err := getRoles(stub, key)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to revoke role, due to %s", err))
+		}
+
+		remaining := roles[:0]
+		for _, granted := range roles {
+			if granted != params[1] {
+				remaining = append(remaining, granted)
+			}
+		}
+
+		rolesBytes, err := json.Marshal(remaining)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to revoke role, due to %s", err))
+		}
+		if err := stub.PutState(key, rolesBytes); err != nil {
+			return shim.Error(fmt.Sprintf("failed to revoke role, due to %s", err))
+		}
+
+		return shim.Success(nil)
+	},
+	"getHistory": func(stub shim.ChaincodeStubInterface, params []string) peer.Response {
+		if len(params) != 2 {
+			return shim.Error(fmt.Sprintf("wrong number of parameters(use: accountNumber, symbol)"))
+		}
+
+		accountNumber := params[0]
+		symbol := params[1]
+
+		key, err := accountKey(stub, accountNumber, symbol)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to read history of %s/%s, due to %s", accountNumber, symbol, err))
+		}
+
+		historyIterator, err := stub.GetHistoryForKey(key)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to read history of %s/%s, due to %s", accountNumber, symbol, err))
+		}
+		defer historyIterator.Close()
+
+		var balances []BalanceSnapshot
 		for historyIterator.HasNext() {
-			response, err := historyIterator.Next()
+			modification, err := historyIterator.Next()
+			if err != nil {
+				return shim.Error(fmt.Sprintf("failed to read history of %s/%s, due to %s", accountNumber, symbol, err))
+			}
+
+			balances = append(balances, BalanceSnapshot{
+				TxID:      modification.TxId,
+				Value:     string(modification.Value),
+				IsDelete:  modification.IsDelete,
+				Timestamp: modification.Timestamp,
+			})
+		}
+
+		txIterator, err := stub.GetStateByPartialCompositeKey("tx", []string{accountNumber, symbol})
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to read transfers of %s/%s, due to %s", accountNumber, symbol, err))
+		}
+		defer txIterator.Close()
+
+		var transactions []SignedTx
+		for txIterator.HasNext() {
+			entry, err := txIterator.Next()
 			if err != nil {
-				return shim.Error("failed get Next() for historyIterator")
+				return shim.Error(fmt.Sprintf("failed to read transfers of %s/%s, due to %s", accountNumber, symbol, err))
 			}
 
-			if response.Value >= 0 {
-				history = append(history, fmt.Sprintf("+%s", response.Value))
+			var record TxRecord
+			if err := json.Unmarshal(entry.Value, &record); err != nil {
+				return shim.Error(fmt.Sprintf("failed to deserialize transfer record %s, due to %s", entry.Key, err))
+			}
+
+			signedTx := SignedTx{TxID: record.TxID, Amount: record.Amount, Timestamp: record.Timestamp}
+			if record.From == accountNumber {
+				signedTx.Amount = -record.Amount
+				signedTx.Counterparty = record.To
 			} else {
-				history = append(history, string(response.Value))
+				signedTx.Counterparty = record.From
 			}
+
+			transactions = append(transactions, signedTx)
 		}
 
-		return shim.Success(history)
+		resultBytes, err := json.Marshal(struct {
+			Balances     []BalanceSnapshot `json:"balances"`
+			Transactions []SignedTx        `json:"transactions"`
+		}{balances, transactions})
+		if err != nil {
+			return shim.Error(fmt.Sprintf("failed to serialize history of %s/%s, due to %s", accountNumber, symbol, err))
+		}
+
+		return shim.Success(resultBytes)
 	},
 }
 
+// adminActions maps action names that require a role, via requireRole, to
+// the role that grants access. The identity that instantiated the chaincode
+// always passes, regardless of granted roles.
+var adminActions = map[string]string{
+	"addAccount":       "admin",
+	"addAccountsBatch": "admin",
+	"delAccount":       "admin",
+	"grantRole":        "admin",
+	"revokeRole":       "admin",
+}
+
 func (b bankManagement) Init(stub shim.ChaincodeStubInterface) peer.Response {
 	fmt.Println("Bank Management chaincode is initialized")
+
+	admin, err := callerIdentity(stub)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("failed to record chaincode admin, due to %s", err))
+	}
+
+	if err := stub.PutState(adminKey, []byte(admin)); err != nil {
+		return shim.Error(fmt.Sprintf("failed to record chaincode admin, due to %s", err))
+	}
+
 	return shim.Success(nil)
 }
 
@@ -182,6 +1131,12 @@ func (b bankManagement) Invoke(stub shim.ChaincodeStubInterface) peer.Response {
 		return shim.Error("unknown operation")
 	}
 
+	if role, restricted := adminActions[funcName]; restricted {
+		if err := requireRole(stub, role); err != nil {
+			return shim.Error(fmt.Sprintf("access denied for %s, due to %s", funcName, err))
+		}
+	}
+
 	return action(stub, params)
 }
 
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/common/cauthdsl"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/shimtest"
+	"github.com/hyperledger/fabric/protos/msp"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// mockIdentity builds a serialized MSP identity good enough for
+// cid.GetMSPID/cid.GetX509Certificate to parse, so tests can exercise
+// callerIdentity-gated logic (requireRole, requireIssuer, endorsement
+// ownership) without a real fabric-ca-issued certificate.
+func mockIdentity(t *testing.T, mspID, commonName string) []byte {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Unix(0, 0),
+		NotAfter:     time.Unix(0, 0).AddDate(100, 0, 0),
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	identity, err := proto.Marshal(&msp.SerializedIdentity{Mspid: mspID, IdBytes: certPEM})
+	if err != nil {
+		t.Fatalf("failed to marshal identity: %s", err)
+	}
+
+	return identity
+}
+
+// stubPersonChaincode stands in for the real personCC chaincode that
+// addAccount validates the person id against.
+type stubPersonChaincode struct{}
+
+func (stubPersonChaincode) Init(stub shim.ChaincodeStubInterface) peer.Response {
+	return shim.Success(nil)
+}
+
+func (stubPersonChaincode) Invoke(stub shim.ChaincodeStubInterface) peer.Response {
+	return shim.Success(nil)
+}
+
+func newStubAs(t *testing.T, mspID, commonName string) *shimtest.MockStub {
+	t.Helper()
+
+	stub := shimtest.NewMockStub("bank", new(bankManagement))
+	stub.Creator = mockIdentity(t, mspID, commonName)
+	stub.MockPeerChaincode("personCC/mychannel", shimtest.NewMockStub("personCC", new(stubPersonChaincode)))
+
+	return stub
+}
+
+func mustInvoke(t *testing.T, stub *shimtest.MockStub, txID string, args ...string) peer.Response {
+	t.Helper()
+
+	byteArgs := make([][]byte, len(args))
+	for i, a := range args {
+		byteArgs[i] = []byte(a)
+	}
+
+	return stub.MockInvoke(txID, byteArgs)
+}
+
+func TestRequireRole_AdminAlwaysAllowed(t *testing.T) {
+	stub := newStubAs(t, "Org1MSP", "admin")
+	if resp := stub.MockInit("tx0", nil); resp.Status != shim.OK {
+		t.Fatalf("init failed: %s", resp.Message)
+	}
+
+	account := `{"person_id":1,"account_number":"acc-1","balance":0}`
+	if resp := mustInvoke(t, stub, "tx1", "addAccount", account); resp.Status != shim.OK {
+		t.Fatalf("expected admin to be allowed to addAccount, got error: %s", resp.Message)
+	}
+}
+
+func TestRequireRole_DeniedUntilGranted(t *testing.T) {
+	admin := newStubAs(t, "Org1MSP", "admin")
+	if resp := admin.MockInit("tx0", nil); resp.Status != shim.OK {
+		t.Fatalf("init failed: %s", resp.Message)
+	}
+
+	other := newStubAs(t, "Org2MSP", "teller")
+	other.State = admin.State
+
+	account := `{"person_id":2,"account_number":"acc-2","balance":0}`
+	if resp := mustInvoke(t, other, "tx1", "addAccount", account); resp.Status == shim.OK {
+		t.Fatalf("expected addAccount to be denied without the admin role")
+	}
+
+	if resp := mustInvoke(t, admin, "tx2", "grantRole", "Org2MSP/teller", "admin"); resp.Status != shim.OK {
+		t.Fatalf("grantRole failed: %s", resp.Message)
+	}
+	other.State = admin.State
+
+	if resp := mustInvoke(t, other, "tx3", "addAccount", account); resp.Status != shim.OK {
+		t.Fatalf("expected addAccount to be allowed once admin role is granted, got: %s", resp.Message)
+	}
+}
+
+func TestRequireIssuer_OnlyIssuerMayMint(t *testing.T) {
+	issuer := newStubAs(t, "Org1MSP", "admin")
+	if resp := issuer.MockInit("tx0", nil); resp.Status != shim.OK {
+		t.Fatalf("init failed: %s", resp.Message)
+	}
+
+	if resp := mustInvoke(t, issuer, "tx1", "createToken", `{"symbol":"USD","name":"US Dollar"}`); resp.Status != shim.OK {
+		t.Fatalf("createToken failed: %s", resp.Message)
+	}
+
+	account := `{"person_id":1,"account_number":"acc-1","balance":0}`
+	if resp := mustInvoke(t, issuer, "tx2", "addAccount", account); resp.Status != shim.OK {
+		t.Fatalf("addAccount failed: %s", resp.Message)
+	}
+
+	notIssuer := newStubAs(t, "Org2MSP", "someone-else")
+	notIssuer.State = issuer.State
+
+	if resp := mustInvoke(t, notIssuer, "tx3", "mintToken", "USD", "acc-1", "10"); resp.Status == shim.OK {
+		t.Fatalf("expected mint by a non-issuer to be rejected")
+	}
+
+	if resp := mustInvoke(t, issuer, "tx4", "mintToken", "USD", "acc-1", "10"); resp.Status != shim.OK {
+		t.Fatalf("expected mint by the issuer to succeed, got: %s", resp.Message)
+	}
+}
+
+// TestEndorsementPolicy_UsesRegisteringOrgNotFirstWriter guards against the
+// race previously fixed in this commit: the org that first writes an
+// account's composite balance key (here, the token issuer minting) must not
+// become its required endorser. Only the org that registered the account
+// via addAccount should.
+func TestEndorsementPolicy_UsesRegisteringOrgNotFirstWriter(t *testing.T) {
+	owner := newStubAs(t, "Org1MSP", "admin")
+	if resp := owner.MockInit("tx0", nil); resp.Status != shim.OK {
+		t.Fatalf("init failed: %s", resp.Message)
+	}
+
+	account := `{"person_id":1,"account_number":"acc-1","balance":0}`
+	if resp := mustInvoke(t, owner, "tx1", "addAccount", account); resp.Status != shim.OK {
+		t.Fatalf("addAccount failed: %s", resp.Message)
+	}
+
+	issuer := newStubAs(t, "Org2MSP", "issuer")
+	issuer.State = owner.State
+
+	if resp := mustInvoke(t, issuer, "tx2", "createToken", `{"symbol":"USD","name":"US Dollar"}`); resp.Status != shim.OK {
+		t.Fatalf("createToken failed: %s", resp.Message)
+	}
+
+	if resp := mustInvoke(t, issuer, "tx3", "mintToken", "USD", "acc-1", "10"); resp.Status != shim.OK {
+		t.Fatalf("mintToken failed: %s", resp.Message)
+	}
+
+	key, err := issuer.CreateCompositeKey("account", []string{"acc-1", "USD"})
+	if err != nil {
+		t.Fatalf("failed to build account key: %s", err)
+	}
+
+	policy, err := issuer.GetStateValidationParameter(key)
+	if err != nil {
+		t.Fatalf("failed to read endorsement policy: %s", err)
+	}
+	if policy == nil {
+		t.Fatalf("expected an endorsement policy to be set on %s", key)
+	}
+
+	expected, err := cauthdsl.SignedByAnyMember([]string{"Org1MSP"})
+	if err != nil {
+		t.Fatalf("failed to build expected endorsement policy: %s", err)
+	}
+	if !bytes.Equal(policy, expected) {
+		t.Fatalf("expected the endorsement policy on %s to name Org1MSP, the registering org", key)
+	}
+
+	accountState, err := owner.GetState("acc-1")
+	if err != nil {
+		t.Fatalf("failed to read bank account: %s", err)
+	}
+
+	var registered BankAccount
+	if err := json.Unmarshal(accountState, &registered); err != nil {
+		t.Fatalf("failed to deserialize bank account: %s", err)
+	}
+	if registered.OwnerMSP != "Org1MSP" {
+		t.Fatalf("expected OwnerMSP to be Org1MSP, got %s", registered.OwnerMSP)
+	}
+}